@@ -4,21 +4,18 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/alecthomas/kong"
-	"github.com/google/uuid"
-	"github.com/jmespath/go-jmespath"
+
+	"github.com/WillAbides/eventgrid-pipe/pkg/egpipe"
 )
 
 var kongVars = kong.Vars{
@@ -31,23 +28,42 @@ var kongVars = kong.Vars{
 	"id_help":      `Value for the "id" field. If unset, a uuid will be generated for each event. JMESPath expressions allowed with "jp:" prefix.`,
 	"subject_help": `Value for the "subject" field. JMESPath expressions allowed with "jp:" prefix.`,
 	"type_help":    `Value for the "eventType" field. JMESPath expressions allowed with "jp:" prefix.`,
-	"time_help": `Value for the "eventTime" field converted from epoch milliseconds. If unset, the current 
+	"time_help": `Value for the "eventTime" field converted from epoch milliseconds. If unset, the current
 system time will be used.JMESPath expressions allowed with "jp:" prefix.`,
+
+	"schema_help": `Output schema to publish events with. "eventgrid" sends the Event Grid schema, "cloudevents" sends a CloudEvents 1.0 JSON batch.`,
+	"source_help": `Value for the CloudEvents "source" field. Required when --schema=cloudevents. JMESPath expressions allowed with "jp:" prefix.`,
+
+	"max_retries_help":      `Maximum number of retries for a batch before giving up on it. Set to 0 to disable retries.`,
+	"retry_base_ms_help":    `Base delay in milliseconds for exponential backoff between retries. Doubles after each attempt.`,
+	"retry_max_ms_help":     `Maximum delay in milliseconds between retries.`,
+	"dead_letter_file_help": `File to append failed batches to (as the raw JSON that was posted) once retries are exhausted, instead of failing.`,
+
+	"request_timeout_help":  `Time in milliseconds to wait for a single publish request before giving up on it.`,
+	"shutdown_timeout_help": `Time in milliseconds to wait for buffered events to drain after receiving SIGINT/SIGTERM.`,
+
+	"max_in_flight_help": `Maximum number of batches to post concurrently. Event ordering within a batch is always preserved, but setting this above 1 means batches may complete out of order relative to each other.`,
 }
 
 type cliOptions struct {
-	TopicEndpoint string   `kong:"arg,required,help=${topic_endpoint_help}"`
-	ID            string   `kong:"short=i,help=${id_help}"`
-	Subject       string   `kong:"required,short=s,help=${subject_help}"`
-	EventType     string   `kong:"required,short=t,name='type',help=${type_help}"`
-	EventTime     string   `kong:"name='timestamp',short=T,default='now',help=${time_help}"`
-	Header        []string `kong:"short=H,help=${header_help}"`
-	DataVersion   string   `kong:"default=1.0,help=${data_version_help}"`
-	BatchSize     int      `kong:"default=10,help=${batch_size_help}"`
-	FlushInterval int      `kong:"default=2000,help=${flush_interval_help}"`
-
-	jmespaths map[string]*jmespath.JMESPath
-	optDefs   map[string]string
+	TopicEndpoint   string   `kong:"arg,required,help=${topic_endpoint_help}"`
+	ID              string   `kong:"short=i,help=${id_help}"`
+	Subject         string   `kong:"required,short=s,help=${subject_help}"`
+	EventType       string   `kong:"required,short=t,name='type',help=${type_help}"`
+	EventTime       string   `kong:"name='timestamp',short=T,default='now',help=${time_help}"`
+	Header          []string `kong:"short=H,help=${header_help}"`
+	DataVersion     string   `kong:"default=1.0,help=${data_version_help}"`
+	BatchSize       int      `kong:"default=10,help=${batch_size_help}"`
+	FlushInterval   int      `kong:"default=2000,help=${flush_interval_help}"`
+	Schema          string   `kong:"enum='eventgrid,cloudevents',default='eventgrid',help=${schema_help}"`
+	Source          string   `kong:"help=${source_help}"`
+	MaxRetries      int      `kong:"default=5,help=${max_retries_help}"`
+	RetryBaseMs     int      `kong:"default=200,help=${retry_base_ms_help}"`
+	RetryMaxMs      int      `kong:"default=30000,help=${retry_max_ms_help}"`
+	DeadLetterFile  string   `kong:"name='dead-letter-file',help=${dead_letter_file_help}"`
+	RequestTimeout  int      `kong:"name='request-timeout',default=10000,help=${request_timeout_help}"`
+	ShutdownTimeout int      `kong:"name='shutdown-timeout',default=10000,help=${shutdown_timeout_help}"`
+	MaxInFlight     int      `kong:"name='max-in-flight',default=1,help=${max_in_flight_help}"`
 }
 
 const helpDescription = `egpipe posts events to Azure Event Grid.
@@ -72,8 +88,6 @@ Learn about JMESPath syntax at https://jmespath.org
 
 `
 
-const jmespathPrefix = "jp:"
-
 func main() {
 	var cli cliOptions
 	k := kong.Parse(&cli, kongVars, kong.Description(helpDescription))
@@ -83,21 +97,6 @@ func main() {
 	k.FatalIfErrorf(err)
 }
 
-type lineData struct {
-	data  []byte
-	iface interface{}
-}
-
-func (l lineData) unmarshalled() (interface{}, error) {
-	if l.iface == nil {
-		err := json.Unmarshal(l.data, &l.iface)
-		if err != nil {
-			return nil, err
-		}
-	}
-	return l.iface, nil
-}
-
 func (c *cliOptions) url() (string, error) {
 	th := c.TopicEndpoint
 	if !strings.Contains(th, `://`) {
@@ -131,264 +130,86 @@ func run(ctx context.Context, cli *cliOptions, scanner *bufio.Scanner) error {
 		header.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
 	}
 
+	if cli.Schema == string(egpipe.SchemaCloudEvents) && cli.Source == "" {
+		return fmt.Errorf("--source is required when --schema=%s", egpipe.SchemaCloudEvents)
+	}
+
 	thURL, err := cli.url()
 	if err != nil {
 		return err
 	}
-	publisher := &eventGridPublisher{
-		resetTicker:  func() {},
-		maxQueueSize: cli.BatchSize,
-		endpoint:     thURL,
-		reqHeader:    header,
+
+	tmpl, err := egpipe.NewEventTemplate(cli.ID, cli.Subject, cli.EventType, cli.EventTime, cli.DataVersion, cli.Source)
+	if err != nil {
+		return err
 	}
 
-	doneMutex := new(sync.Mutex)
-	done := false
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(c)
 	go func() {
-		<-c
-		doneMutex.Lock()
-		done = true
-		doneMutex.Unlock()
-	}()
-
-	if cli.FlushInterval != 0 {
-		interval := time.Duration(cli.FlushInterval) * time.Millisecond
-		ticker := time.NewTicker(interval)
-		publisher.resetTicker = func() {
-			ticker.Reset(interval)
+		select {
+		case <-c:
+			cancel()
+		case <-ctx.Done():
 		}
-		go func() {
-			for range ticker.C {
-				err2 := publisher.flushIfNeeded(ctx, 0)
-				if err2 != nil {
-					os.Exit(1)
-				}
-			}
-		}()
-	}
+	}()
 
+	publisher := egpipe.NewPublisher(ctx, egpipe.Options{
+		Endpoint:       thURL,
+		Header:         header,
+		BatchSize:      cli.BatchSize,
+		FlushInterval:  time.Duration(cli.FlushInterval) * time.Millisecond,
+		Schema:         egpipe.Schema(cli.Schema),
+		MaxRetries:     cli.MaxRetries,
+		RetryBaseDelay: time.Duration(cli.RetryBaseMs) * time.Millisecond,
+		RetryMaxDelay:  time.Duration(cli.RetryMaxMs) * time.Millisecond,
+		DeadLetterFile: cli.DeadLetterFile,
+		RequestTimeout: time.Duration(cli.RequestTimeout) * time.Millisecond,
+		MaxInFlight:    cli.MaxInFlight,
+	})
+
+	var scanErr error
+scanLoop:
 	for scanner.Scan() {
+		select {
+		case err = <-publisher.Errs():
+			break scanLoop
+		case <-ctx.Done():
+			break scanLoop
+		default:
+		}
 		b := scanner.Bytes()
 		b = bytes.TrimSpace(b)
 		if len(b) == 0 {
 			continue
 		}
-		var ev *event
-		ev, err = buildEvent(cli, scanner.Bytes())
+		var ev *egpipe.Event
+		ev, err = tmpl.BuildEvent(scanner.Bytes())
 		if err != nil {
-			return err
+			break scanLoop
 		}
-		err = publisher.addEvent(ctx, ev)
+		err = publisher.Publish(ctx, ev)
 		if err != nil {
-			return err
-		}
-		if done {
-			break
+			break scanLoop
 		}
 	}
-	err = publisher.flushIfNeeded(ctx, 0)
-	if err != nil {
-		return err
+	if err == nil {
+		scanErr = scanner.Err()
 	}
-	return scanner.Err()
-}
 
-func (c *cliOptions) jmespath(name, val string) (*jmespath.JMESPath, error) {
-	var err error
-	if !strings.HasPrefix(val, jmespathPrefix) {
-		return nil, nil
-	}
-	if c.jmespaths == nil {
-		c.jmespaths = map[string]*jmespath.JMESPath{}
-	}
-	if c.jmespaths[name] == nil {
-		c.jmespaths[name], err = jmespath.Compile(strings.TrimPrefix(val, jmespathPrefix))
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), time.Duration(cli.ShutdownTimeout)*time.Millisecond)
+	defer drainCancel()
+	if drainErr := publisher.Close(drainCtx); drainErr != nil {
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("%w (while draining after: %v)", drainErr, err)
 		}
+		return drainErr
 	}
-	return c.jmespaths[name], nil
-}
-
-func (c *cliOptions) optDef(name string) string {
-	if c.optDefs == nil {
-		c.optDefs = map[string]string{
-			"subject":     c.Subject,
-			"id":          c.ID,
-			"eventType":   c.EventType,
-			"eventTime":   c.EventTime,
-			"dataVersion": c.DataVersion,
-		}
-	}
-	return c.optDefs[name]
-}
-
-func (c *cliOptions) getVal(valName string, data lineData) (string, error) {
-	optDef := c.optDef(valName)
-
-	if strings.HasPrefix(optDef, jmespathPrefix) {
-		jp, err := c.jmespath(valName, optDef)
-		if err != nil {
-			return "", err
-		}
-		jd, err := data.unmarshalled()
-		if err != nil {
-			return "", err
-		}
-		return jmespathString(jp, jd)
-	}
-	return optDef, nil
-}
-
-func buildEvent(cli *cliOptions, data []byte) (*event, error) {
-	ev := new(event)
-
-	ld := lineData{
-		data: data,
-	}
-	var err error
-	ev.ID, err = cli.getVal("id", ld)
-	if err != nil {
-		return nil, err
-	}
-	if ev.ID == "" {
-		ev.ID = uuid.New().String()
-	}
-
-	ev.Subject, err = cli.getVal("subject", ld)
-	if err != nil {
-		return nil, err
-	}
-
-	ev.DataVersion, err = cli.getVal("dataVersion", ld)
-	if err != nil {
-		return nil, err
-	}
-
-	ev.EventTime, err = cli.eventTime(ld)
-	if err != nil {
-		return nil, err
-	}
-
-	ev.EventType, err = cli.getVal("eventType", ld)
-	if err != nil {
-		return nil, err
-	}
-
-	ev.Data = json.RawMessage(data)
-
-	return ev, nil
-}
-
-func (c *cliOptions) eventTime(ld lineData) (string, error) {
-	strVal, err := c.getVal("eventTime", ld)
-	if err != nil {
-		return "", err
-	}
-	if strVal == "now" {
-		return time.Now().UTC().Format(time.RFC3339Nano), nil
-	}
-	iVal, err := strconv.ParseInt(strVal, 10, 64)
-	if err != nil {
-		return "", err
-	}
-	secs := iVal / 1000
-	ms := iVal % 1000
-	ns := ms * int64(time.Millisecond)
-	return time.Unix(secs, ns).UTC().Format(time.RFC3339Nano), nil
-}
-
-func jmespathString(jp *jmespath.JMESPath, data interface{}) (string, error) {
-	got, err := jp.Search(data)
-	if err != nil {
-		return "", err
-	}
-	switch val := got.(type) {
-	case string:
-		return val, nil
-	case float64:
-		return fmt.Sprintf("%.0f", val), nil
-	default:
-		return fmt.Sprintf("%v", val), nil
-	}
-}
-
-type eventGridPublisher struct {
-	mutex        sync.Mutex
-	endpoint     string
-	httpClient   *http.Client
-	reqHeader    http.Header
-	maxQueueSize int
-	cache        []*event
-	resetTicker  func()
-}
-
-func (p *eventGridPublisher) addEvent(ctx context.Context, ev *event) error {
-	p.mutex.Lock()
-	p.cache = append(p.cache, ev)
-	if len(p.cache) == 1 {
-		p.resetTicker()
-	}
-	p.mutex.Unlock()
-	return p.flushIfNeeded(ctx, p.maxQueueSize)
-}
-
-func (p *eventGridPublisher) flushIfNeeded(ctx context.Context, maxQueueSize int) error {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
-	if len(p.cache) == 0 || len(p.cache) < maxQueueSize {
-		return nil
-	}
-	err := p.flush(ctx)
 	if err != nil {
 		return err
 	}
-	p.cache = p.cache[:0]
-	return nil
-}
-
-func (p *eventGridPublisher) flush(ctx context.Context) error {
-	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(p.cache)
-	if err != nil {
-		return err
-	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, &buf)
-	if err != nil {
-		return err
-	}
-	req.Header = p.reqHeader
-	req.Header.Set("Content-Type", "application/json; charset=utf-8")
-	httpClient := p.httpClient
-	if httpClient == nil {
-		httpClient = http.DefaultClient
-	}
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("not OK, statusCode: %d", resp.StatusCode)
-	}
-	return nil
-}
-
-// event properties of an event published to an event Grid topic using the EventGrid Schema.
-type event struct {
-	// ID - An unique identifier for the event.
-	ID string `json:"id,omitempty"`
-	// Topic - The resource path of the event source.
-	Topic string `json:"topic,omitempty"`
-	// Subject - A resource path relative to the topic path.
-	Subject string `json:"subject,omitempty"`
-	// Data - event data specific to the event type.
-	Data interface{} `json:"data,omitempty"`
-	// EventType - The type of the event that occurred.
-	EventType string `json:"eventType,omitempty"`
-	// EventTime - The time (in UTC) the event was generated.
-	EventTime string `json:"eventTime,omitempty"`
-	// DataVersion - The schema version of the data object.
-	DataVersion string `json:"dataVersion,omitempty"`
+	return scanErr
 }
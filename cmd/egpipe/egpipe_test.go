@@ -7,8 +7,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -114,19 +117,146 @@ func Test_run(t *testing.T) {
 			},
 		},
 	)
-	topicHost := strings.TrimPrefix(ts.server.URL, "http://")
 	cli := &cliOptions{
-		TopicHost: topicHost,
-		Header: map[string]string{
-			"foo": "bar",
-		},
+		TopicEndpoint: ts.server.URL,
+		Header:        []string{"foo: bar"},
 		ID:            "jp:id",
 		Subject:       "my subject",
 		EventType:     "jp:type",
 		EventTime:     "jp:time",
 		DataVersion:   "1.0",
-		PublishScheme: "http",
 	}
 	err := run(ctx, cli, scanner)
 	require.NoError(t, err)
 }
+
+func Test_run_requiresSourceForCloudEvents(t *testing.T) {
+	ctx := context.Background()
+	scanner := bufio.NewScanner(strings.NewReader(""))
+	cli := &cliOptions{
+		TopicEndpoint: "http://example.invalid",
+		Subject:       "my subject",
+		EventType:     "foo",
+		EventTime:     "now",
+		DataVersion:   "1.0",
+		Schema:        "cloudevents",
+	}
+	err := run(ctx, cli, scanner)
+	require.EqualError(t, err, "--source is required when --schema=cloudevents")
+}
+
+func Test_run_cloudEventsSchema(t *testing.T) {
+	ctx := context.Background()
+	scanner := bufio.NewScanner(strings.NewReader(`{"id": "foo", "time": "1608309835000", "type": "foo"}` + "\n"))
+
+	var gotContentType string
+	var gotBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotContentType = r.Header.Get("Content-Type")
+		var err error
+		gotBody, err = ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cli := &cliOptions{
+		TopicEndpoint: server.URL,
+		ID:            "jp:id",
+		Subject:       "my subject",
+		EventType:     "jp:type",
+		EventTime:     "jp:time",
+		DataVersion:   "1.0",
+		Schema:        "cloudevents",
+		Source:        "my-source",
+	}
+	require.NoError(t, run(ctx, cli, scanner))
+
+	assert.Equal(t, "application/cloudevents-batch+json; charset=utf-8", gotContentType)
+	var batch []map[string]interface{}
+	require.NoError(t, json.Unmarshal(gotBody, &batch))
+	require.Len(t, batch, 1)
+	assert.Equal(t, "my-source", batch[0]["source"])
+	assert.Equal(t, "foo", batch[0]["id"])
+}
+
+func Test_run_deadLettersAfterRetriesExhausted(t *testing.T) {
+	ctx := context.Background()
+	scanner := bufio.NewScanner(strings.NewReader(`{"id": "foo", "time": "1608309835000", "type": "foo"}` + "\n"))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	dlFile := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	cli := &cliOptions{
+		TopicEndpoint:  server.URL,
+		ID:             "jp:id",
+		Subject:        "my subject",
+		EventType:      "jp:type",
+		EventTime:      "jp:time",
+		DataVersion:    "1.0",
+		MaxRetries:     1,
+		RetryBaseMs:    1,
+		RetryMaxMs:     1,
+		DeadLetterFile: dlFile,
+	}
+	require.NoError(t, run(ctx, cli, scanner))
+
+	contents, err := ioutil.ReadFile(dlFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(contents), `"id":"foo"`)
+}
+
+func Test_run_requestTimeout(t *testing.T) {
+	ctx := context.Background()
+	scanner := bufio.NewScanner(strings.NewReader(`{"id": "foo", "time": "1608309835000", "type": "foo"}` + "\n"))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cli := &cliOptions{
+		TopicEndpoint:  server.URL,
+		ID:             "jp:id",
+		Subject:        "my subject",
+		EventType:      "jp:type",
+		EventTime:      "jp:time",
+		DataVersion:    "1.0",
+		RequestTimeout: 1,
+	}
+	require.Error(t, run(ctx, cli, scanner))
+}
+
+func Test_run_maxInFlight(t *testing.T) {
+	ctx := context.Background()
+	lines := `{"id": "foo", "time": "1608309835000", "type": "foo"}
+{"id": "bar", "time": "1608309835000", "type": "bar"}
+{"id": "baz", "time": "1608309835000", "type": "baz"}
+{"id": "qux", "time": "1608309835000", "type": "qux"}
+`
+	scanner := bufio.NewScanner(strings.NewReader(lines))
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cli := &cliOptions{
+		TopicEndpoint: server.URL,
+		ID:            "jp:id",
+		Subject:       "my subject",
+		EventType:     "jp:type",
+		EventTime:     "jp:time",
+		DataVersion:   "1.0",
+		BatchSize:     1,
+		MaxInFlight:   4,
+	}
+	require.NoError(t, run(ctx, cli, scanner))
+	assert.EqualValues(t, 4, atomic.LoadInt32(&requests))
+}
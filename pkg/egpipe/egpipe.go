@@ -0,0 +1,526 @@
+// Package egpipe batches events and publishes them to an Azure Event Grid custom topic,
+// either under the native Event Grid schema or as a CloudEvents 1.0 JSON batch.
+package egpipe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Schema identifies the wire format a Publisher uses when posting batches.
+type Schema string
+
+const (
+	// SchemaEventGrid publishes batches using the Event Grid schema. This is the default.
+	SchemaEventGrid Schema = "eventgrid"
+	// SchemaCloudEvents publishes batches as a CloudEvents 1.0 JSON batch.
+	SchemaCloudEvents Schema = "cloudevents"
+)
+
+const cloudEventsSpecVersion = "1.0"
+
+// Event is a single event to publish. It is serialized using the Event Grid schema unless
+// Options.Schema is SchemaCloudEvents, in which case it is converted to CloudEvents 1.0.
+type Event struct {
+	// ID - An unique identifier for the event.
+	ID string `json:"id,omitempty"`
+	// Topic - The resource path of the event source.
+	Topic string `json:"topic,omitempty"`
+	// Subject - A resource path relative to the topic path.
+	Subject string `json:"subject,omitempty"`
+	// Data - event data specific to the event type.
+	Data interface{} `json:"data,omitempty"`
+	// EventType - The type of the event that occurred.
+	EventType string `json:"eventType,omitempty"`
+	// EventTime - The time (in UTC) the event was generated.
+	EventTime string `json:"eventTime,omitempty"`
+	// DataVersion - The schema version of the data object.
+	DataVersion string `json:"dataVersion,omitempty"`
+	// Source - the CloudEvents source URI. Only used when publishing with SchemaCloudEvents.
+	Source string `json:"-"`
+}
+
+// cloudEvent is the CloudEvents 1.0 JSON representation of an Event.
+type cloudEvent struct {
+	// SpecVersion - the version of the CloudEvents spec the event conforms to.
+	SpecVersion string `json:"specversion"`
+	// ID - An unique identifier for the event.
+	ID string `json:"id"`
+	// Source - identifies the context in which the event happened.
+	Source string `json:"source"`
+	// Type - the type of the event that occurred.
+	Type string `json:"type"`
+	// Time - the time (in UTC) the event was generated.
+	Time string `json:"time,omitempty"`
+	// DataContentType - the content type of Data.
+	DataContentType string `json:"datacontenttype,omitempty"`
+	// Subject - a resource path relative to the event source.
+	Subject string `json:"subject,omitempty"`
+	// Data - event data specific to the event type.
+	Data interface{} `json:"data,omitempty"`
+}
+
+// cloudEvent converts ev to its CloudEvents 1.0 representation.
+func (ev *Event) cloudEvent() *cloudEvent {
+	return &cloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              ev.ID,
+		Source:          ev.Source,
+		Type:            ev.EventType,
+		Time:            ev.EventTime,
+		DataContentType: "application/json",
+		Subject:         ev.Subject,
+		Data:            ev.Data,
+	}
+}
+
+// Options configure a Publisher.
+type Options struct {
+	// Endpoint is the full URL events are POSTed to.
+	Endpoint string
+	// Header is sent with every publish request, e.g. for the "aeg-sas-key" auth header.
+	Header http.Header
+	// BatchSize is the number of events to accumulate before publishing a batch.
+	BatchSize int
+	// FlushInterval is how long to wait before publishing a partial batch. Zero disables
+	// the background flush; batches are only sent when they reach BatchSize or Flush is
+	// called explicitly.
+	FlushInterval time.Duration
+	// HTTPClient is used to publish batches. http.DefaultClient is used if nil.
+	HTTPClient *http.Client
+	// Schema selects the wire format batches are published with. SchemaEventGrid is used
+	// if empty.
+	Schema Schema
+	// MaxRetries is the maximum number of retries for a batch before giving up on it. Zero
+	// disables retries.
+	MaxRetries int
+	// RetryBaseDelay is the base delay for exponential backoff between retries. It doubles
+	// after each attempt, up to RetryMaxDelay.
+	RetryBaseDelay time.Duration
+	// RetryMaxDelay is the maximum delay between retries.
+	RetryMaxDelay time.Duration
+	// DeadLetterFile, if set, receives batches (as the raw JSON that was posted) that
+	// failed after all retries were exhausted, so Flush/Publish/Close report success and
+	// processing can continue instead of failing outright.
+	DeadLetterFile string
+	// RequestTimeout bounds each individual publish HTTP request. Zero means no per-request
+	// timeout is applied beyond the context passed to Publish/Flush/Close.
+	RequestTimeout time.Duration
+	// MaxInFlight is the number of batches that may be posted concurrently. One by default.
+	// Event ordering within a batch is always preserved, but raising MaxInFlight above one
+	// means batches may complete out of order relative to each other.
+	MaxInFlight int
+}
+
+// batchJob is a sealed batch handed off to the worker pool, together with the context it
+// should be posted with. That context carries the values of whichever Publish/Flush/Close
+// call sealed the batch, but not its cancellation: once a batch is sealed it is committed to
+// being posted (see sealAndEnqueue), so it must not be abandoned mid-POST or mid-retry just
+// because the caller's context was later canceled, e.g. by a SIGINT that also cancels the
+// scan loop.
+type batchJob struct {
+	ctx    context.Context
+	events []*Event
+}
+
+// Publisher batches Events and publishes them to an Event Grid (or CloudEvents) endpoint.
+// Sealed batches are handed off to a pool of Options.MaxInFlight worker goroutines, so
+// Publish only blocks when that pool is saturated. A Publisher is safe for concurrent use.
+type Publisher struct {
+	opts Options
+
+	mutex sync.Mutex
+	cache []*Event
+
+	batches    chan batchJob
+	inFlightWG sync.WaitGroup
+	eg         *errgroup.Group
+	// egCtx is canceled only when a worker returns a terminal error, stopping its siblings.
+	// It is deliberately not derived from the ctx passed to NewPublisher: that ctx is
+	// typically tied to process-lifetime cancellation (e.g. SIGINT), and canceling it must
+	// not abort batches already sealed and handed off for Close to drain.
+	egCtx context.Context
+
+	errOnce sync.Once
+	errMu   sync.Mutex
+	err     error
+	errc    chan error
+
+	ticker *time.Ticker
+	tickWG sync.WaitGroup
+	done   chan struct{}
+}
+
+// NewPublisher returns a Publisher configured with opts. A pool of Options.MaxInFlight (at
+// least one) worker goroutines is started immediately to post sealed batches. If
+// opts.FlushInterval is positive, a background goroutine also seals and hands off partial
+// batches on that interval, until ctx is canceled or Close is called.
+func NewPublisher(ctx context.Context, opts Options) *Publisher {
+	maxInFlight := opts.MaxInFlight
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	eg, egCtx := errgroup.WithContext(context.Background())
+	p := &Publisher{
+		opts:    opts,
+		batches: make(chan batchJob, maxInFlight),
+		eg:      eg,
+		egCtx:   egCtx,
+		errc:    make(chan error, 1),
+	}
+	for i := 0; i < maxInFlight; i++ {
+		eg.Go(p.worker)
+	}
+	if opts.FlushInterval > 0 {
+		p.ticker = time.NewTicker(opts.FlushInterval)
+		p.done = make(chan struct{})
+		p.tickWG.Add(1)
+		go p.tick(ctx)
+	}
+	return p
+}
+
+// worker pulls sealed batches off p.batches and posts each one using the context it was
+// sealed with, until the channel is closed or p.egCtx is canceled by another worker's
+// terminal error.
+func (p *Publisher) worker() error {
+	for {
+		select {
+		case job, ok := <-p.batches:
+			if !ok {
+				return nil
+			}
+			err := p.publishBatch(job.ctx, job.events)
+			p.inFlightWG.Done()
+			if err != nil {
+				p.setErr(err)
+				return err
+			}
+		case <-p.egCtx.Done():
+			return p.egCtx.Err()
+		}
+	}
+}
+
+func (p *Publisher) setErr(err error) {
+	p.errOnce.Do(func() {
+		p.errMu.Lock()
+		p.err = err
+		p.errMu.Unlock()
+		select {
+		case p.errc <- err:
+		default:
+		}
+	})
+}
+
+func (p *Publisher) loadErr() error {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	return p.err
+}
+
+func (p *Publisher) tick(ctx context.Context) {
+	defer p.tickWG.Done()
+	for {
+		select {
+		case <-p.ticker.C:
+			if err := p.sealAndEnqueue(ctx, 0); err != nil {
+				p.setErr(err)
+				return
+			}
+		case <-p.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Errs returns a channel that receives the first error from a background flush (driven by
+// Options.FlushInterval) or from a worker, so a caller that isn't already waiting on a
+// Publish/Flush/Close call can still learn about it.
+func (p *Publisher) Errs() <-chan error {
+	return p.errc
+}
+
+// Publish adds ev to the current batch, sealing and handing it off to the worker pool if it
+// has reached Options.BatchSize. It blocks only if the worker pool is saturated.
+func (p *Publisher) Publish(ctx context.Context, ev *Event) error {
+	if err := p.loadErr(); err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	p.cache = append(p.cache, ev)
+	if len(p.cache) == 1 && p.ticker != nil {
+		p.ticker.Reset(p.opts.FlushInterval)
+	}
+	p.mutex.Unlock()
+	return p.sealAndEnqueue(ctx, p.opts.BatchSize)
+}
+
+// Flush seals and hands off any buffered events, regardless of Options.BatchSize, then
+// waits for every batch handed off so far (including concurrently in-flight ones) to
+// finish.
+func (p *Publisher) Flush(ctx context.Context) error {
+	if err := p.sealAndEnqueue(ctx, 0); err != nil {
+		return err
+	}
+	return p.waitInFlight(ctx)
+}
+
+// Close stops the background flush goroutine, if any, hands off any remaining buffered
+// events, and waits for the worker pool to finish and exit before returning.
+func (p *Publisher) Close(ctx context.Context) error {
+	if p.done != nil {
+		close(p.done)
+		p.ticker.Stop()
+		p.tickWG.Wait()
+	}
+	sealErr := p.sealAndEnqueue(ctx, 0)
+	close(p.batches)
+	waitErr := p.eg.Wait()
+	if sealErr != nil {
+		return sealErr
+	}
+	if waitErr != nil {
+		return waitErr
+	}
+	return p.loadErr()
+}
+
+// sealAndEnqueue swaps out the current batch, if it has at least maxQueueSize events, and
+// hands it off to the worker pool. The handoff blocks if the pool's bounded channel is
+// full, applying backpressure to the caller.
+//
+// Once a batch is sealed it is committed to being posted (and, on failure, dead-lettered)
+// regardless of what happens to ctx afterward: it is posted with context.WithoutCancel(ctx),
+// so canceling ctx (e.g. SIGINT canceling the scan loop's context) can't abort a POST or
+// retry sequence already under way, and a handoff that can't complete before ctx or p.egCtx
+// is done is recovered via deadLetter instead of being silently dropped.
+func (p *Publisher) sealAndEnqueue(ctx context.Context, maxQueueSize int) error {
+	p.mutex.Lock()
+	if len(p.cache) == 0 || len(p.cache) < maxQueueSize {
+		p.mutex.Unlock()
+		return nil
+	}
+	sealed := p.cache
+	p.cache = nil
+	p.mutex.Unlock()
+
+	p.inFlightWG.Add(1)
+	select {
+	case p.batches <- batchJob{ctx: context.WithoutCancel(ctx), events: sealed}:
+		return nil
+	case <-ctx.Done():
+		p.inFlightWG.Done()
+		return p.recoverUnhandedOff(sealed, ctx.Err())
+	case <-p.egCtx.Done():
+		p.inFlightWG.Done()
+		return p.recoverUnhandedOff(sealed, p.egCtx.Err())
+	}
+}
+
+// recoverUnhandedOff dead-letters a batch that was sealed but never handed off to the
+// worker pool, e.g. because ctx was canceled while the pool was saturated. If no dead
+// letter file is configured, cause is returned unchanged, matching publishBatch's own
+// failure handling.
+func (p *Publisher) recoverUnhandedOff(events []*Event, cause error) error {
+	_, body, err := p.encodeBatch(events)
+	if err != nil {
+		return fmt.Errorf("failed to hand off batch (%w), and failed to encode it for dead-lettering: %v", cause, err)
+	}
+	return p.deadLetter(body, cause)
+}
+
+// waitInFlight blocks until every batch handed off so far has been posted, or ctx is done,
+// or the worker pool has terminally failed.
+func (p *Publisher) waitInFlight(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.inFlightWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.egCtx.Done():
+	}
+	return p.loadErr()
+}
+
+func (p *Publisher) publishBatch(ctx context.Context, events []*Event) error {
+	contentType, body, err := p.encodeBatch(events)
+	if err != nil {
+		return err
+	}
+
+	err = p.postWithRetry(ctx, contentType, body)
+	if err == nil {
+		return nil
+	}
+	return p.deadLetter(body, err)
+}
+
+// encodeBatch serializes events in the configured schema, returning the Content-Type to
+// publish them with alongside the raw request body.
+func (p *Publisher) encodeBatch(events []*Event) (string, []byte, error) {
+	var buf bytes.Buffer
+	contentType := "application/json; charset=utf-8"
+	if p.opts.Schema == SchemaCloudEvents {
+		contentType = "application/cloudevents-batch+json; charset=utf-8"
+		batch := make([]*cloudEvent, len(events))
+		for i, ev := range events {
+			batch[i] = ev.cloudEvent()
+		}
+		if err := json.NewEncoder(&buf).Encode(batch); err != nil {
+			return "", nil, err
+		}
+	} else {
+		if err := json.NewEncoder(&buf).Encode(events); err != nil {
+			return "", nil, err
+		}
+	}
+	return contentType, buf.Bytes(), nil
+}
+
+// postWithRetry posts body to p.opts.Endpoint, retrying on 429 and 5xx responses and
+// network errors with exponential backoff and jitter until p.opts.MaxRetries is exhausted.
+// Other 4xx responses are treated as permanent failures and returned immediately.
+func (p *Publisher) postWithRetry(ctx context.Context, contentType string, body []byte) error {
+	var lastErr error
+	var retryAfter time.Duration
+	delay := p.opts.RetryBaseDelay
+	for attempt := 0; attempt <= p.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			wait := jitter(delay)
+			if retryAfter > 0 {
+				wait = retryAfter
+			}
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			delay *= 2
+			if delay > p.opts.RetryMaxDelay {
+				delay = p.opts.RetryMaxDelay
+			}
+		}
+		var err error
+		retryAfter, err = p.post(ctx, contentType, body)
+		if err == nil {
+			return nil
+		}
+		var permErr *permanentError
+		if errors.As(err, &permErr) {
+			return err
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+// permanentError marks a post failure that postWithRetry must not retry, e.g. a non-429 4xx
+// response: retrying a malformed batch or a rejected auth header can't ever succeed.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// post makes a single publish attempt. On a 429 response it returns the duration from the
+// Retry-After header so the caller can honor it before the next attempt. Non-429 4xx
+// responses are returned as a *permanentError, since retrying them can't help.
+func (p *Publisher) post(ctx context.Context, contentType string, body []byte) (time.Duration, error) {
+	if p.opts.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.opts.RequestTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	header := p.opts.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Content-Type", contentType)
+	req.Header = header
+	httpClient := p.opts.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return 0, nil
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return parseRetryAfter(resp.Header.Get("Retry-After")), fmt.Errorf("not OK, statusCode: %d", resp.StatusCode)
+	}
+	if resp.StatusCode >= 500 {
+		return 0, fmt.Errorf("not OK, statusCode: %d", resp.StatusCode)
+	}
+	return 0, &permanentError{err: fmt.Errorf("not OK, statusCode: %d", resp.StatusCode)}
+}
+
+// deadLetter appends body to p.opts.DeadLetterFile after cause has exhausted retries. If no
+// dead letter file is configured, cause is returned unchanged.
+func (p *Publisher) deadLetter(body []byte, cause error) error {
+	if p.opts.DeadLetterFile == "" {
+		return cause
+	}
+	f, err := os.OpenFile(p.opts.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to publish batch (%w), and failed to open dead letter file: %v", cause, err)
+	}
+	defer f.Close()
+	if _, err = f.Write(append(body, '\n')); err != nil {
+		return fmt.Errorf("failed to publish batch (%w), and failed to write dead letter file: %v", cause, err)
+	}
+	return nil
+}
+
+// jitter returns a random duration in [d/2, d], softening retry storms against a
+// simultaneously-recovering endpoint.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2+1)))
+}
+
+// parseRetryAfter parses a Retry-After header value, which may be either a number of
+// seconds or an HTTP-date. It returns 0 if v is empty or unparsable.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
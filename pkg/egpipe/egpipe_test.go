@@ -0,0 +1,260 @@
+package egpipe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvent_cloudEvent(t *testing.T) {
+	ev := &Event{
+		ID:          "1",
+		Subject:     "subj",
+		Data:        map[string]interface{}{"a": float64(1)},
+		EventType:   "type",
+		EventTime:   "2020-12-18T16:43:55Z",
+		DataVersion: "1.0",
+		Source:      "my-source",
+	}
+	ce := ev.cloudEvent()
+	assert.Equal(t, cloudEventsSpecVersion, ce.SpecVersion)
+	assert.Equal(t, ev.ID, ce.ID)
+	assert.Equal(t, ev.Source, ce.Source)
+	assert.Equal(t, ev.EventType, ce.Type)
+	assert.Equal(t, ev.EventTime, ce.Time)
+	assert.Equal(t, "application/json", ce.DataContentType)
+	assert.Equal(t, ev.Subject, ce.Subject)
+	assert.Equal(t, ev.Data, ce.Data)
+}
+
+func TestPublisher_encodeBatch_cloudEvents(t *testing.T) {
+	p := &Publisher{opts: Options{Schema: SchemaCloudEvents}}
+	contentType, body, err := p.encodeBatch([]*Event{{ID: "1", Source: "src", EventType: "t"}})
+	require.NoError(t, err)
+	assert.Equal(t, "application/cloudevents-batch+json; charset=utf-8", contentType)
+
+	var batch []map[string]interface{}
+	require.NoError(t, json.Unmarshal(body, &batch))
+	require.Len(t, batch, 1)
+	assert.Equal(t, "src", batch[0]["source"])
+	assert.Equal(t, cloudEventsSpecVersion, batch[0]["specversion"])
+}
+
+func TestPublisher_postWithRetry_retriesTooManyRequests(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	p := &Publisher{opts: Options{
+		Endpoint:       server.URL,
+		MaxRetries:     5,
+		RetryBaseDelay: time.Millisecond,
+		RetryMaxDelay:  10 * time.Millisecond,
+	}}
+	err := p.postWithRetry(context.Background(), "application/json", []byte("[]"))
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&attempts))
+}
+
+func TestPublisher_postWithRetry_permanentFailureDoesNotRetry(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	p := &Publisher{opts: Options{
+		Endpoint:       server.URL,
+		MaxRetries:     5,
+		RetryBaseDelay: time.Millisecond,
+		RetryMaxDelay:  10 * time.Millisecond,
+	}}
+	err := p.postWithRetry(context.Background(), "application/json", []byte("[]"))
+	require.Error(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&attempts))
+}
+
+func TestPublisher_publishBatch_deadLetterOnExhaustedRetries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	dlFile := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	p := &Publisher{opts: Options{
+		Endpoint:       server.URL,
+		MaxRetries:     1,
+		RetryBaseDelay: time.Millisecond,
+		RetryMaxDelay:  time.Millisecond,
+		DeadLetterFile: dlFile,
+	}}
+	events := []*Event{{ID: "1", Subject: "s", EventType: "t"}}
+	require.NoError(t, p.publishBatch(context.Background(), events))
+
+	contents, err := ioutil.ReadFile(dlFile)
+	require.NoError(t, err)
+	var got []map[string]interface{}
+	require.NoError(t, json.Unmarshal(bytes.TrimSpace(contents), &got))
+	require.Len(t, got, 1)
+	assert.Equal(t, "1", got[0]["id"])
+}
+
+func TestPublisher_post_concurrentRequestsDoNotShareHeader(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	p := &Publisher{opts: Options{
+		Endpoint: server.URL,
+		Header:   http.Header{"Aeg-Sas-Key": []string{"shh"}},
+	}}
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := p.post(context.Background(), "application/json", []byte("[]"))
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, n, atomic.LoadInt32(&requests))
+}
+
+func TestPublisher_Close_drainsSealedBatchAfterCallerContextCanceled(t *testing.T) {
+	delivered := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- struct{}{}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewPublisher(ctx, Options{
+		Endpoint:  server.URL,
+		BatchSize: 10,
+	})
+	require.NoError(t, p.Publish(ctx, &Event{ID: "1"}))
+
+	// Simulate a SIGINT canceling the Publisher's root context, as cmd/egpipe does.
+	cancel()
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), time.Second)
+	defer drainCancel()
+	require.NoError(t, p.Close(drainCtx))
+
+	select {
+	case <-delivered:
+	default:
+		t.Fatal("buffered event was not delivered while draining")
+	}
+}
+
+func TestPublisher_worker_completesPostDespiteCallerContextCancellation(t *testing.T) {
+	posted := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		posted <- struct{}{}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewPublisher(ctx, Options{
+		Endpoint:  server.URL,
+		BatchSize: 1,
+	})
+	require.NoError(t, p.Publish(ctx, &Event{ID: "1"}))
+
+	// Cancel while the POST the Publish above triggered is still in flight.
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), time.Second)
+	defer drainCancel()
+	require.NoError(t, p.Close(drainCtx))
+
+	select {
+	case <-posted:
+	default:
+		t.Fatal("batch sealed before cancellation was abandoned instead of completing")
+	}
+}
+
+func TestPublisher_sealAndEnqueue_deadLettersOnHandoffTimeout(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	dlFile := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	ctx := context.Background()
+	p := NewPublisher(ctx, Options{
+		Endpoint:       server.URL,
+		BatchSize:      1,
+		MaxInFlight:    1,
+		DeadLetterFile: dlFile,
+	})
+
+	require.NoError(t, p.Publish(ctx, &Event{ID: "1"})) // occupies the one worker
+	require.NoError(t, p.Publish(ctx, &Event{ID: "2"})) // fills the one channel slot
+
+	shortCtx, shortCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer shortCancel()
+	err := p.Publish(shortCtx, &Event{ID: "3"})
+	require.NoError(t, err)
+
+	contents, err := ioutil.ReadFile(dlFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(contents), `"id":"3"`)
+
+	close(block)
+	require.NoError(t, p.Close(context.Background()))
+}
+
+func TestPublisher_Close_MaxInFlightGreaterThanOne(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	p := NewPublisher(ctx, Options{
+		Endpoint:    server.URL,
+		BatchSize:   1,
+		MaxInFlight: 4,
+	})
+	for i := 0; i < 40; i++ {
+		require.NoError(t, p.Publish(ctx, &Event{ID: "1"}))
+	}
+	require.NoError(t, p.Close(context.Background()))
+	assert.EqualValues(t, 40, atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,187 @@
+package egpipe
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmespath/go-jmespath"
+)
+
+// JMESPathPrefix marks a field value as a JMESPath expression to evaluate against each
+// line's JSON data, rather than a literal string.
+const JMESPathPrefix = "jp:"
+
+// LineData lazily unmarshals a line of JSON so multiple field specs can share the parse.
+type LineData struct {
+	data  []byte
+	iface interface{}
+}
+
+// NewLineData wraps a raw line of JSON for use with EventTemplate.BuildEvent.
+func NewLineData(data []byte) LineData {
+	return LineData{data: data}
+}
+
+// Unmarshalled returns the line's data unmarshalled as interface{}, unmarshalling it on
+// first use.
+func (l *LineData) Unmarshalled() (interface{}, error) {
+	if l.iface == nil {
+		err := json.Unmarshal(l.data, &l.iface)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l.iface, nil
+}
+
+// fieldSpec is a literal string, or, if the value it was compiled from had the
+// JMESPathPrefix, a compiled JMESPath expression evaluated against each line's JSON data.
+type fieldSpec struct {
+	literal string
+	jp      *jmespath.JMESPath
+}
+
+func compileFieldSpec(val string) (fieldSpec, error) {
+	if !strings.HasPrefix(val, JMESPathPrefix) {
+		return fieldSpec{literal: val}, nil
+	}
+	jp, err := jmespath.Compile(strings.TrimPrefix(val, JMESPathPrefix))
+	if err != nil {
+		return fieldSpec{}, err
+	}
+	return fieldSpec{jp: jp}, nil
+}
+
+func (f fieldSpec) value(ld *LineData) (string, error) {
+	if f.jp == nil {
+		return f.literal, nil
+	}
+	jd, err := ld.Unmarshalled()
+	if err != nil {
+		return "", err
+	}
+	return jmespathString(f.jp, jd)
+}
+
+func jmespathString(jp *jmespath.JMESPath, data interface{}) (string, error) {
+	got, err := jp.Search(data)
+	if err != nil {
+		return "", err
+	}
+	switch val := got.(type) {
+	case string:
+		return val, nil
+	case float64:
+		return fmt.Sprintf("%.0f", val), nil
+	default:
+		return fmt.Sprintf("%v", val), nil
+	}
+}
+
+// EventTemplate derives Events from lines of JSON, using field values that are either
+// literal strings or, when prefixed with JMESPathPrefix, JMESPath expressions evaluated
+// against each line.
+type EventTemplate struct {
+	id          fieldSpec
+	subject     fieldSpec
+	eventType   fieldSpec
+	eventTime   fieldSpec
+	dataVersion fieldSpec
+	source      fieldSpec
+}
+
+// NewEventTemplate compiles id, subject, eventType, eventTime, dataVersion and source into
+// an EventTemplate, returning an error if any JMESPathPrefix-ed value fails to compile.
+//
+// eventTime is special-cased: a literal value of "now" means BuildEvent uses the current
+// time rather than treating "now" as data. Any other resolved value must be epoch
+// milliseconds.
+func NewEventTemplate(id, subject, eventType, eventTime, dataVersion, source string) (*EventTemplate, error) {
+	var t EventTemplate
+	var err error
+	for _, f := range []struct {
+		dst *fieldSpec
+		val string
+	}{
+		{&t.id, id},
+		{&t.subject, subject},
+		{&t.eventType, eventType},
+		{&t.eventTime, eventTime},
+		{&t.dataVersion, dataVersion},
+		{&t.source, source},
+	} {
+		*f.dst, err = compileFieldSpec(f.val)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+// BuildEvent derives an Event from a line of JSON according to t. An empty resolved ID is
+// replaced with a generated uuid.
+func (t *EventTemplate) BuildEvent(data []byte) (*Event, error) {
+	ld := new(LineData)
+	*ld = NewLineData(data)
+	ev := new(Event)
+	var err error
+
+	ev.ID, err = t.id.value(ld)
+	if err != nil {
+		return nil, err
+	}
+	if ev.ID == "" {
+		ev.ID = uuid.New().String()
+	}
+
+	ev.Subject, err = t.subject.value(ld)
+	if err != nil {
+		return nil, err
+	}
+
+	ev.DataVersion, err = t.dataVersion.value(ld)
+	if err != nil {
+		return nil, err
+	}
+
+	ev.EventTime, err = t.resolveEventTime(ld)
+	if err != nil {
+		return nil, err
+	}
+
+	ev.EventType, err = t.eventType.value(ld)
+	if err != nil {
+		return nil, err
+	}
+
+	ev.Source, err = t.source.value(ld)
+	if err != nil {
+		return nil, err
+	}
+
+	ev.Data = json.RawMessage(data)
+
+	return ev, nil
+}
+
+func (t *EventTemplate) resolveEventTime(ld *LineData) (string, error) {
+	strVal, err := t.eventTime.value(ld)
+	if err != nil {
+		return "", err
+	}
+	if strVal == "now" {
+		return time.Now().UTC().Format(time.RFC3339Nano), nil
+	}
+	iVal, err := strconv.ParseInt(strVal, 10, 64)
+	if err != nil {
+		return "", err
+	}
+	secs := iVal / 1000
+	ms := iVal % 1000
+	ns := ms * int64(time.Millisecond)
+	return time.Unix(secs, ns).UTC().Format(time.RFC3339Nano), nil
+}